@@ -0,0 +1,280 @@
+//Package client implements the chisel client: it dials one of a
+//configured set of chisel servers, binds the resulting ssh connection to
+//a tunnel.Tunnel, and reconnects - failing over across servers with
+//per-endpoint health/backoff - whenever the connection drops.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/endpoint"
+	"github.com/jpillora/chisel/share/metrics"
+	"github.com/jpillora/chisel/share/settings"
+	"github.com/jpillora/chisel/share/tunnel"
+	"golang.org/x/crypto/ssh"
+)
+
+//Config configures a Client.
+type Config struct {
+	*cio.Logger
+	//Server is a single upstream chisel server address. Ignored if
+	//Servers is set; kept for single-server configs.
+	Server string
+	//Servers lists every upstream chisel server this client fails over
+	//between. ServerSelector controls the order Pool.Next() tries them in.
+	Servers        []string
+	ServerSelector endpoint.Selector
+	Remotes        []string
+	Auth           string
+	KeepAlive      time.Duration
+	//MaxRetryInterval bounds the delay between reconnect attempts.
+	MaxRetryInterval time.Duration
+	//MaxRetryCount bounds how many reconnect attempts are made; negative
+	//means retry forever.
+	MaxRetryCount int
+	//MetricsListen, when set, serves Prometheus metrics for this
+	//client's Tunnel on this address's /metrics.
+	MetricsListen string
+}
+
+//Client is a chisel client: Start dials Config's server pool and keeps
+//the connection alive, reconnecting with health-based failover across
+//Config.Servers whenever it drops.
+type Client struct {
+	Config
+	pool    *endpoint.Pool
+	remotes []*settings.Remote
+	tunnel  *tunnel.Tunnel
+	metrics *metrics.Collectors
+
+	curAddrMut sync.Mutex
+	curAddr    string
+
+	cancel  context.CancelFunc
+	donec   chan struct{}
+	waitErr error
+	waitMut sync.Mutex
+}
+
+//NewClient validates c and builds the endpoint pool and remotes a
+//Client will dial and bind once started.
+func NewClient(c *Config) (*Client, error) {
+	servers := c.Servers
+	if len(servers) == 0 {
+		if c.Server == "" {
+			return nil, errors.New("no server configured")
+		}
+		servers = []string{c.Server}
+	}
+	remotes := make([]*settings.Remote, len(c.Remotes))
+	for i, r := range c.Remotes {
+		remote, err := settings.DecodeRemote(r)
+		if err != nil {
+			return nil, fmt.Errorf("remote %q: %s", r, err)
+		}
+		remotes[i] = remote
+	}
+	selector := c.ServerSelector
+	if selector == "" {
+		selector = endpoint.RoundRobin
+	}
+	client := &Client{
+		Config:  *c,
+		pool:    endpoint.NewPool(selector, 3, time.Second, 2*time.Minute, servers...),
+		remotes: remotes,
+		donec:   make(chan struct{}),
+	}
+	client.Logger = client.Logger.Fork("client")
+	if c.MetricsListen != "" {
+		client.metrics = metrics.New()
+	}
+	client.tunnel = tunnel.New(tunnel.Config{
+		Logger:      client.Logger,
+		Inbound:     true,
+		Outbound:    true,
+		KeepAlive:   c.KeepAlive,
+		Metrics:     client.metrics,
+		OnKeepAlive: client.onKeepAlive,
+	})
+	return client, nil
+}
+
+//onKeepAlive feeds a keepalive ping's result back into the endpoint pool
+//against whichever server the Tunnel is currently bound to, so a flaky
+//server accrues backoff the same way a failed dial does.
+func (c *Client) onKeepAlive(rtt time.Duration, err error) {
+	addr := c.currentAddr()
+	if err != nil {
+		c.pool.MarkFailure(addr)
+		return
+	}
+	c.pool.MarkSuccess(addr, rtt)
+}
+
+func (c *Client) setCurrentAddr(addr string) {
+	c.curAddrMut.Lock()
+	c.curAddr = addr
+	c.curAddrMut.Unlock()
+}
+
+func (c *Client) currentAddr() string {
+	c.curAddrMut.Lock()
+	defer c.curAddrMut.Unlock()
+	return c.curAddr
+}
+
+//Start launches the connect-retry loop in the background and returns
+//immediately; use Wait to block until it exits.
+func (c *Client) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	if c.metrics != nil {
+		go func() {
+			if err := c.metrics.ListenAndServe(ctx, c.MetricsListen); err != nil {
+				c.Debugf("metrics server failed: %s", err)
+			}
+		}()
+	}
+	go c.connectLoop(ctx)
+	return nil
+}
+
+//connectLoop repeatedly dials the pool's next endpoint, reports the
+//outcome back into the pool, and backs off between attempts, until ctx
+//is cancelled or MaxRetryCount is exceeded.
+func (c *Client) connectLoop(ctx context.Context) {
+	defer close(c.donec)
+	retries := 0
+	for {
+		if isDone(ctx) {
+			return
+		}
+		ep := c.pool.Next()
+		if c.metrics != nil {
+			c.metrics.ReconnectAttempts.Inc()
+		}
+		if err := c.connectOnce(ctx, ep.Addr); err != nil {
+			c.pool.MarkFailure(ep.Addr)
+			c.Debugf("connection to %s failed: %s", ep.Addr, err)
+		}
+		if isDone(ctx) {
+			return
+		}
+		retries++
+		if c.Config.MaxRetryCount >= 0 && retries > c.Config.MaxRetryCount {
+			c.setWaitErr(fmt.Errorf("exceeded max retry count (%d)", c.Config.MaxRetryCount))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.backoff(retries)):
+		}
+	}
+}
+
+//connectOnce dials addr, binds it to the client's Tunnel and, while
+//connected, binds Config.Remotes as proxies. It blocks until the ssh
+//connection drops or ctx is cancelled.
+func (c *Client) connectOnce(ctx context.Context, addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, c.sshConfig())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c.pool.MarkSuccess(addr, 0)
+	c.setCurrentAddr(addr)
+	c.Debugf("connected to %s", addr)
+	bindCtx, bindCancel := context.WithCancel(ctx)
+	defer bindCancel()
+	if len(c.remotes) > 0 {
+		go func() {
+			if err := c.tunnel.BindRemotes(bindCtx, c.remotes); err != nil {
+				c.Debugf("bind remotes ended: %s", err)
+			}
+		}()
+	}
+	return c.tunnel.BindSSH(ctx, sshConn, reqs, chans)
+}
+
+//sshConfig builds the ssh client handshake config from Config.Auth,
+//formatted "user:pass" the same way the server's Authenticator expects.
+func (c *Client) sshConfig() *ssh.ClientConfig {
+	user, pass := "", ""
+	if i := strings.IndexByte(c.Auth, ':'); i >= 0 {
+		user, pass = c.Auth[:i], c.Auth[i+1:]
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(pass)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         settings.EnvDuration("SSH_WAIT", 35*time.Second),
+	}
+}
+
+//backoff returns how long to wait before the n'th retry, growing
+//linearly up to MaxRetryInterval.
+func (c *Client) backoff(n int) time.Duration {
+	d := time.Duration(n) * time.Second
+	if c.Config.MaxRetryInterval > 0 && d > c.Config.MaxRetryInterval {
+		d = c.Config.MaxRetryInterval
+	}
+	if d <= 0 {
+		d = time.Second
+	}
+	return d
+}
+
+//Wait blocks until the connect loop exits - on Close, ctx cancellation,
+//or MaxRetryCount being exceeded - and returns the reason, if any.
+func (c *Client) Wait() error {
+	<-c.donec
+	return c.getWaitErr()
+}
+
+func (c *Client) setWaitErr(err error) {
+	c.waitMut.Lock()
+	c.waitErr = err
+	c.waitMut.Unlock()
+}
+
+func (c *Client) getWaitErr() error {
+	c.waitMut.Lock()
+	defer c.waitMut.Unlock()
+	return c.waitErr
+}
+
+//Close cancels the connect loop and closes the current ssh connection,
+//if any.
+func (c *Client) Close() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	return c.tunnel.Close(context.Background())
+}
+
+//Tunnel returns the client's underlying Tunnel, used by the SIGHUP
+//restart hand-off (ListenerFiles) and drain (SetDraining/ActiveConnCount).
+func (c *Client) Tunnel() *tunnel.Tunnel {
+	return c.tunnel
+}
+
+func isDone(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
@@ -4,6 +4,11 @@ import (
 	"context"
 	chclient "github.com/jpillora/chisel/client"
 	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -21,15 +26,76 @@ func main() {
 		log.Fatalln(err)
 	}
 	client.Debug = true
-	//time.AfterFunc(10*time.Second, func() {
-	//	client.Close()
-	//})
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	if err = client.Start(ctx); err != nil {
 		log.Fatalln("client.Start err:", err)
 	}
+	go handleSignals(ctx, cancel, client)
 	if err = client.Wait(); err != nil {
 		log.Fatalln("client.Wait err:", err)
 	}
 }
+
+//handleSignals implements a zero-downtime restart: SIGHUP re-execs
+//os.Args[0] with the current listener fds passed through ExtraFiles, then
+//drains in-flight connections before exiting. SIGTERM/SIGINT drain without
+//re-exec. SIGQUIT closes immediately.
+func handleSignals(ctx context.Context, cancel context.CancelFunc, client *chclient.Client) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGQUIT:
+			log.Println("SIGQUIT: closing immediately")
+			cancel()
+			return
+		case syscall.SIGHUP:
+			log.Println("SIGHUP: re-executing with inherited listeners")
+			if err := reexec(client); err != nil {
+				log.Println("re-exec failed, continuing:", err)
+				continue
+			}
+			drainAndExit(ctx, client)
+			return
+		case syscall.SIGTERM, syscall.SIGINT:
+			log.Println("draining before exit:", sig)
+			drainAndExit(ctx, client)
+			return
+		}
+	}
+}
+
+//reexec forks a replacement process, handing off this client's proxy
+//listener file descriptors so the child can rebuild them instead of
+//calling net.Listen, avoiding any gap in accepted connections.
+func reexec(client *chclient.Client) error {
+	files, err := client.Tunnel().ListenerFiles()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), "CHISEL_LISTEN_FDS="+strconv.Itoa(len(files)))
+	return cmd.Start()
+}
+
+//drainAndExit stops accepting new SSH channels and waits for in-flight
+//proxy connections to reach zero before closing the tunnel and exiting.
+func drainAndExit(ctx context.Context, client *chclient.Client) {
+	t := client.Tunnel()
+	t.SetDraining(true)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if t.ActiveConnCount() == 0 {
+			break
+		}
+		<-ticker.C
+	}
+	client.Close()
+	os.Exit(0)
+}
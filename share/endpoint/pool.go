@@ -0,0 +1,169 @@
+//Package endpoint implements a small health-aware pool of upstream chisel
+//servers for the client reconnect loop, so a client can be configured with
+//more than one Server and fail over between them.
+package endpoint
+
+import (
+	"sync"
+	"time"
+)
+
+//Selector picks the order in which healthy endpoints are tried.
+type Selector string
+
+const (
+	//RoundRobin cycles through healthy endpoints in turn.
+	RoundRobin Selector = "round-robin"
+	//Priority always prefers the earliest-listed healthy endpoint.
+	Priority Selector = "priority"
+	//Latency prefers the healthy endpoint with the lowest measured ping RTT.
+	Latency Selector = "latency"
+)
+
+//Endpoint is a single upstream chisel server.
+type Endpoint struct {
+	Addr string
+}
+
+type health struct {
+	failures int
+	healthy  bool
+	rtt      time.Duration
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+//Pool tracks a set of Endpoints and their health, selecting the next one a
+//reconnect loop should dial.
+type Pool struct {
+	mu          sync.Mutex
+	selector    Selector
+	maxFailures int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	endpoints   []*Endpoint
+	health      map[string]*health
+	rrIndex     int
+}
+
+//NewPool builds a Pool of the given addrs, all initially healthy.
+//maxFailures is the number of consecutive failures before an endpoint is
+//marked unhealthy; minBackoff/maxBackoff bound the per-endpoint exponential
+//backoff applied after a failure.
+func NewPool(selector Selector, maxFailures int, minBackoff, maxBackoff time.Duration, addrs ...string) *Pool {
+	p := &Pool{
+		selector:    selector,
+		maxFailures: maxFailures,
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+		health:      map[string]*health{},
+	}
+	for _, a := range addrs {
+		p.endpoints = append(p.endpoints, &Endpoint{Addr: a})
+		p.health[a] = &health{healthy: true}
+	}
+	return p
+}
+
+//Len returns the number of endpoints in the pool.
+func (p *Pool) Len() int {
+	return len(p.endpoints)
+}
+
+//MarkFailure records a failed dial or a dropped KeepAliveChan against addr,
+//marking it unhealthy once maxFailures consecutive failures accrue and
+//scheduling its next retry with exponential backoff.
+func (p *Pool) MarkFailure(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.health[addr]
+	if !ok {
+		return
+	}
+	h.failures++
+	if h.failures >= p.maxFailures {
+		h.healthy = false
+	}
+	if h.backoff == 0 {
+		h.backoff = p.minBackoff
+	} else {
+		h.backoff *= 2
+		if h.backoff > p.maxBackoff {
+			h.backoff = p.maxBackoff
+		}
+	}
+	h.retryAt = time.Now().Add(h.backoff)
+}
+
+//MarkSuccess records a successful dial/keepalive against addr, along with
+//the measured round-trip time used by the Latency selector.
+func (p *Pool) MarkSuccess(addr string, rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.health[addr]
+	if !ok {
+		return
+	}
+	h.failures = 0
+	h.healthy = true
+	h.backoff = 0
+	h.rtt = rtt
+}
+
+//Next returns the endpoint the reconnect loop should try: any endpoint
+//whose backoff has elapsed is a candidate, regardless of its healthy flag
+//- healthy only affects tie-breaking between candidates (the Latency
+//selector, say), never permanent exclusion. An unhealthy endpoint is
+//retried as soon as its backoff (grown by MarkFailure) elapses, so a
+//server that comes back up is picked up again instead of being benched
+//for the rest of the process lifetime. If no endpoint is out of backoff
+//yet, Next returns the one soonest due so the pool never gives up
+//entirely.
+func (p *Pool) Next() *Endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var candidates []*Endpoint
+	for _, e := range p.endpoints {
+		h := p.health[e.Addr]
+		if now.After(h.retryAt) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		return p.soonestRetry()
+	}
+	switch p.selector {
+	case Priority:
+		return candidates[0]
+	case Latency:
+		best := candidates[0]
+		for _, e := range candidates[1:] {
+			h, bh := p.health[e.Addr], p.health[best.Addr]
+			//equal RTTs are broken in favour of a healthy endpoint
+			if h.rtt < bh.rtt || (h.rtt == bh.rtt && h.healthy && !bh.healthy) {
+				best = e
+			}
+		}
+		return best
+	default: //RoundRobin
+		e := candidates[p.rrIndex%len(candidates)]
+		p.rrIndex++
+		return e
+	}
+}
+
+//soonestRetry returns the endpoint with the earliest retryAt, used when no
+//endpoint is out of its backoff yet.
+func (p *Pool) soonestRetry() *Endpoint {
+	var best *Endpoint
+	var bestAt time.Time
+	for _, e := range p.endpoints {
+		h := p.health[e.Addr]
+		if best == nil || h.retryAt.Before(bestAt) {
+			best = e
+			bestAt = h.retryAt
+		}
+	}
+	return best
+}
@@ -0,0 +1,40 @@
+package endpoint
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoolNextRetriesAfterBackoffExpires(t *testing.T) {
+	p := NewPool(RoundRobin, 3, 50*time.Millisecond, 50*time.Millisecond, "a", "b")
+	for i := 0; i < 3; i++ {
+		p.MarkFailure("a")
+	}
+	h := p.health["a"]
+	if h.healthy {
+		t.Fatal("expected a to be unhealthy after 3 failures")
+	}
+	//backoff is still pending: a must not be a candidate yet
+	found := false
+	for i := 0; i < p.Len(); i++ {
+		if p.Next().Addr == "a" {
+			found = true
+		}
+	}
+	if found {
+		t.Fatal("a should not be retried before its backoff elapses")
+	}
+	//advance past the backoff and confirm a becomes eligible again, proving
+	//it is not permanently blacklisted by its stale healthy=false flag
+	h.retryAt = time.Now().Add(-time.Second)
+	seenA := false
+	for i := 0; i < p.Len()*2; i++ {
+		if p.Next().Addr == "a" {
+			seenA = true
+			break
+		}
+	}
+	if !seenA {
+		t.Fatal("expected a to be retried again once its backoff elapsed")
+	}
+}
@@ -0,0 +1,146 @@
+//Package sshgw lets a chisel server accept connections directly from a
+//stock OpenSSH client, in addition to the existing WebSocket-wrapped SSH
+//transport. It speaks raw SSH on the wire, authenticates against the same
+//user store as the WebSocket path, and then hands the resulting ssh.Conn to
+//tunnel.Tunnel.BindSSH so both transports share one request/channel
+//dispatcher.
+package sshgw
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/metrics"
+	"github.com/jpillora/chisel/share/tunnel"
+	"golang.org/x/crypto/ssh"
+)
+
+//Authenticator validates credentials presented by a native ssh client
+//against chisel's existing user store. It is satisfied by the server's
+//user index, kept as an interface here to avoid sshgw depending on the
+//server package.
+type Authenticator interface {
+	//VerifyPassword returns true if user/pass is a valid chisel user.
+	VerifyPassword(user, pass string) (bool, error)
+	//VerifyPublicKey returns true if the given key is authorized for user.
+	VerifyPublicKey(user string, key ssh.PublicKey) (bool, error)
+}
+
+//Config configures a Gateway.
+type Config struct {
+	*cio.Logger
+	//Auth validates credentials, required
+	Auth Authenticator
+	//HostKey signs the server side of the handshake, required
+	HostKey ssh.Signer
+	//MetricsListen, when set, serves Prometheus metrics for every Tunnel
+	//this Gateway creates on this address's /metrics, across all of the
+	//concurrent per-connection Tunnels (see tunnelConfig).
+	MetricsListen string
+}
+
+//Gateway accepts raw ssh connections and binds each to its own tunnel.Tunnel.
+type Gateway struct {
+	Config
+	//tunnelConfig is used as the template for a fresh Tunnel built for
+	//every accepted connection - a Tunnel is one-per-client (see
+	//tunnel.Tunnel's doc comment), so it cannot be shared across the
+	//concurrent native ssh clients this Gateway serves.
+	tunnelConfig tunnel.Config
+}
+
+//New creates a Gateway which binds each accepted connection to a fresh
+//Tunnel built from tunnelConfig. If c.MetricsListen is set, a single
+//metrics.Collectors is created and shared across every Tunnel this
+//Gateway builds, so all concurrent native ssh clients report into one
+///metrics endpoint.
+func New(c Config, tunnelConfig tunnel.Config) *Gateway {
+	c.Logger = c.Logger.Fork("sshgw")
+	if c.MetricsListen != "" {
+		tunnelConfig.Metrics = metrics.New()
+	}
+	return &Gateway{Config: c, tunnelConfig: tunnelConfig}
+}
+
+//sshConfig builds the per-connection ssh.ServerConfig used to authenticate
+//native clients against g.Auth.
+func (g *Gateway) sshConfig() *ssh.ServerConfig {
+	sc := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			ok, err := g.Auth.VerifyPassword(conn.User(), string(pass))
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("invalid credentials for user %q", conn.User())
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			ok, err := g.Auth.VerifyPublicKey(conn.User(), key)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("unauthorized key for user %q", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	sc.AddHostKey(g.HostKey)
+	return sc
+}
+
+//Listen starts accepting native ssh connections on addr. It blocks until
+//ctx is cancelled or the listener fails.
+func (g *Gateway) Listen(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	if g.tunnelConfig.Metrics != nil {
+		go func() {
+			if err := g.tunnelConfig.Metrics.ListenAndServe(ctx, g.MetricsListen); err != nil {
+				g.Debugf("metrics server failed: %s", err)
+			}
+		}()
+	}
+	g.Debugf("Native SSH gateway listening on %s", addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				return err
+			}
+		}
+		go g.handleConn(ctx, conn)
+	}
+}
+
+//handleConn performs the native ssh handshake and, on success, builds a
+//fresh Tunnel for this one connection and hands it to Tunnel.BindSSH - the
+//same dispatcher used by the WebSocket-wrapped transport. A Tunnel may
+//only ever have one active ssh.Conn bound to it at a time (BindSSH panics
+//on a double-bind), so each concurrently accepted native client needs its
+//own Tunnel instance rather than sharing one across the Gateway.
+func (g *Gateway) handleConn(ctx context.Context, conn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, g.sshConfig())
+	if err != nil {
+		g.Debugf("native ssh handshake failed: %s", err)
+		conn.Close()
+		return
+	}
+	t := tunnel.New(g.tunnelConfig)
+	if err := t.BindSSH(ctx, sshConn, reqs, chans); err != nil {
+		g.Debugf("native ssh session ended: %s", err)
+	}
+}
@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//ListenFDsEnv is set by a parent process on SIGHUP re-exec to tell the
+//child how many listener file descriptors were passed through ExtraFiles,
+//starting at fd 3 (0,1,2 are stdin/stdout/stderr).
+const ListenFDsEnv = "CHISEL_LISTEN_FDS"
+
+//InheritedListenerCount reads ListenFDsEnv and returns how many listener
+//file descriptors the current process inherited from its parent.
+func InheritedListenerCount() int {
+	s := os.Getenv(ListenFDsEnv)
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+//InheritedListener rebuilds the net.Listener for the i'th inherited file
+//descriptor (0-indexed) instead of calling net.Listen, used by a child
+//process after a graceful-restart re-exec.
+func InheritedListener(i int) (net.Listener, error) {
+	fd := uintptr(3 + i)
+	f := os.NewFile(fd, fmt.Sprintf("listener-fd-%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid inherited fd %d", fd)
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+	}
+	f.Close()
+	return l, nil
+}
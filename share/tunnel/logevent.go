@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+)
+
+//LogHandler receives structured log events as a machine-parsable event name
+//plus key/value fields (remote_addr, local_addr, proxy_id, remote, count,
+//active_sessions, error). Events do not carry session_id, bytes_in or
+//bytes_out fields. It is satisfied by a thin adapter over
+//log/slog, logrus, or any other structured logger; see Config.LogHandler.
+type LogHandler interface {
+	Handle(event string, kv ...interface{})
+}
+
+//logEvent emits a structured event through Config.LogHandler when one is
+//configured. Otherwise it falls back to the existing cio.Logger.Debugf
+//output so -v/--debug keeps working with no handler wired up.
+func (t *Tunnel) logEvent(event string, kv ...interface{}) {
+	if t.Config.LogHandler != nil {
+		t.Config.LogHandler.Handle(event, kv...)
+		return
+	}
+	if !t.Logger.Debug {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(event)
+	for i := 0; i+1 < len(kv); i += 2 {
+		b.WriteString(" ")
+		if s, ok := kv[i].(string); ok {
+			b.WriteString(s)
+		}
+		b.WriteString("=")
+		b.WriteString(fmt.Sprintf("%v", kv[i+1]))
+	}
+	t.Debugf("%s", b.String())
+}
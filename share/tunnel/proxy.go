@@ -0,0 +1,121 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+//Proxy is the client/server glue between a configured Remote and its
+//listener: one Proxy per Remote, 1:1, accepting local connections and
+//piping them over the tunnel's ssh connection.
+type Proxy struct {
+	*cio.Logger
+	id     int
+	tunnel *Tunnel
+	remote *settings.Remote
+	tcp    net.Listener
+}
+
+//NewProxy creates a Proxy listening for remote's local side. If the
+//current process inherited listener fds from a parent on a SIGHUP
+//re-exec (see fds.go), the id'th inherited fd is rebuilt via
+//InheritedListener instead of a fresh net.Listen, so a restarted process
+//picks its listener straight back up rather than racing (and losing to)
+//the still-bound parent with "address already in use".
+func NewProxy(logger *cio.Logger, t *Tunnel, id int, remote *settings.Remote) (*Proxy, error) {
+	var l net.Listener
+	var err error
+	if id < InheritedListenerCount() {
+		l, err = InheritedListener(id)
+	} else {
+		l, err = net.Listen("tcp", net.JoinHostPort(remote.LocalHost, remote.LocalPort))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{
+		Logger: logger.Fork(fmt.Sprintf("proxy#%d", id)),
+		id:     id,
+		tunnel: t,
+		remote: remote,
+		tcp:    l,
+	}, nil
+}
+
+//Run accepts connections on the proxy's listener until ctx is cancelled,
+//the tunnel starts draining (SetDraining(true), e.g. during a SIGHUP
+//restart hand-off), or the listener fails. Draining stops new local
+//connections from being accepted at all, rather than merely rejecting
+//the SSH channel demuxChannels would have opened for them - otherwise a
+//draining process keeps accepting on (and, on restart, keeps racing the
+//child for) its listener indefinitely.
+func (p *Proxy) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				p.tcp.Close()
+				return
+			case <-ticker.C:
+				if p.tunnel.IsDraining() {
+					p.tcp.Close()
+					return
+				}
+			}
+		}
+	}()
+	for {
+		src, err := p.tcp.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+				return err
+			}
+		}
+		go p.accept(ctx, src)
+	}
+}
+
+//accept pipes a single accepted local connection over the tunnel's ssh
+//connection to remote's remote side.
+func (p *Proxy) accept(ctx context.Context, src net.Conn) {
+	defer src.Close()
+	sshConn := p.tunnel.getSSH(ctx)
+	if sshConn == nil {
+		p.Debugf("no SSH connection, dropping")
+		return
+	}
+	dst, reqs, err := sshConn.OpenChannel("chisel", []byte(p.remote.Remote()))
+	if err != nil {
+		p.Debugf("open channel failed: %s", err)
+		return
+	}
+	defer dst.Close()
+	go ssh.DiscardRequests(reqs)
+	sid := nextSessionID()
+	p.tunnel.connStats.Open()
+	p.tunnel.trackSession(p.id, sid, src.RemoteAddr())
+	if p.tunnel.Metrics != nil {
+		p.tunnel.Metrics.ProxyOpens.WithLabelValues(p.remote.Remote()).Inc()
+	}
+	defer p.tunnel.connStats.Close()
+	defer p.tunnel.untrackSession(p.id, sid)
+	defer func() {
+		if p.tunnel.Metrics != nil {
+			p.tunnel.Metrics.ProxyCloses.WithLabelValues(p.remote.Remote()).Inc()
+		}
+	}()
+	p.tunnel.pipe(dst, src)
+}
@@ -0,0 +1,256 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//nativeSessionProxyID groups sessions opened over raw RFC 4254 channels
+//(native ssh -L/-R/-D, not tied to a configured chisel Remote/Proxy) in
+//the per-proxy session registry.
+const nativeSessionProxyID = -1
+
+var sessionCounter int64
+
+//nextSessionID returns a process-unique id for a newly opened session,
+//used as the per-channel key in the session registry by both the native
+//ssh handlers below and the ordinary proxy path (see proxy.go).
+func nextSessionID() string {
+	return fmt.Sprintf("sess-%d", atomic.AddInt64(&sessionCounter, 1))
+}
+
+//rfc4254DirectTCPIP is the payload of a "direct-tcpip" channel open request,
+//used by stock ssh clients for `ssh -L` and `ssh -D`.
+type rfc4254DirectTCPIP struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+//rfc4254TCPIPForward is the payload of a "tcpip-forward" / "cancel-tcpip-forward"
+//global request, used by stock ssh clients for `ssh -R`.
+type rfc4254TCPIPForward struct {
+	Addr string
+	Port uint32
+}
+
+//rfc4254ForwardedTCPIP is the payload chisel sends back when opening a
+//"forwarded-tcpip" channel for a connection accepted on a remote-forwarded
+//listener.
+type rfc4254ForwardedTCPIP struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+//demuxRequests splits off RFC 4254 "tcpip-forward"/"cancel-tcpip-forward"
+//global requests (native ssh -R) and handles them directly, forwarding
+//everything else untouched to chisel's own request handler.
+func (t *Tunnel) demuxRequests(c ssh.Conn, reqs <-chan *ssh.Request) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+	go func() {
+		defer close(out)
+		for r := range reqs {
+			switch r.Type {
+			case "tcpip-forward":
+				t.handleTCPIPForward(c, r)
+			case "cancel-tcpip-forward":
+				t.handleCancelTCPIPForward(c, r)
+			default:
+				out <- r
+			}
+		}
+	}()
+	return out
+}
+
+//demuxChannels splits off RFC 4254 "direct-tcpip" channel-open requests
+//(native ssh -L / ssh -D) and handles them directly, forwarding everything
+//else untouched to chisel's own channel handler.
+func (t *Tunnel) demuxChannels(c ssh.Conn, chans <-chan ssh.NewChannel) <-chan ssh.NewChannel {
+	out := make(chan ssh.NewChannel)
+	go func() {
+		defer close(out)
+		for ch := range chans {
+			if t.IsDraining() {
+				ch.Reject(ssh.ResourceShortage, "server draining")
+				continue
+			}
+			if ch.ChannelType() == "direct-tcpip" {
+				go t.handleDirectTCPIP(ch)
+				continue
+			}
+			out <- ch
+		}
+	}()
+	return out
+}
+
+//handleDirectTCPIP services a single "direct-tcpip" channel by dialing the
+//requested address locally and piping the channel to/from the connection,
+//the same way an `L:` remote proxies a single stream.
+func (t *Tunnel) handleDirectTCPIP(nc ssh.NewChannel) {
+	req := rfc4254DirectTCPIP{}
+	if err := ssh.Unmarshal(nc.ExtraData(), &req); err != nil {
+		nc.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+	addr := fmt.Sprintf("%s:%d", req.Addr, req.Port)
+	dst, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Debugf("direct-tcpip: dial %s failed: %s", addr, err)
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer dst.Close()
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		t.Debugf("direct-tcpip: accept failed: %s", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	sid := nextSessionID()
+	t.connStats.Open()
+	t.trackSession(nativeSessionProxyID, sid, dst.RemoteAddr())
+	if t.Metrics != nil {
+		t.Metrics.ProxyOpens.WithLabelValues(addr).Inc()
+	}
+	defer t.connStats.Close()
+	defer t.untrackSession(nativeSessionProxyID, sid)
+	defer func() {
+		if t.Metrics != nil {
+			t.Metrics.ProxyCloses.WithLabelValues(addr).Inc()
+		}
+	}()
+	t.pipe(ch, dst)
+}
+
+//handleTCPIPForward registers a local listener for a "tcpip-forward" global
+//request and, for each accepted connection, opens a "forwarded-tcpip"
+//channel back to the client - the server-side equivalent of an `R:` remote.
+func (t *Tunnel) handleTCPIPForward(c ssh.Conn, r *ssh.Request) {
+	req := rfc4254TCPIPForward{}
+	if err := ssh.Unmarshal(r.Payload, &req); err != nil {
+		r.Reply(false, nil)
+		return
+	}
+	addr := fmt.Sprintf("%s:%d", req.Addr, req.Port)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Debugf("tcpip-forward: listen %s failed: %s", addr, err)
+		r.Reply(false, nil)
+		return
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	r.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+	t.activeForwardsMut.Lock()
+	t.activeForwards[addr] = l
+	t.activeForwardsMut.Unlock()
+	go func() {
+		defer func() {
+			t.activeForwardsMut.Lock()
+			delete(t.activeForwards, addr)
+			t.activeForwardsMut.Unlock()
+		}()
+		for {
+			src, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go t.forwardTCPIP(c, req.Addr, port, src)
+		}
+	}()
+}
+
+//handleCancelTCPIPForward tears down a listener previously registered by
+//handleTCPIPForward.
+func (t *Tunnel) handleCancelTCPIPForward(c ssh.Conn, r *ssh.Request) {
+	req := rfc4254TCPIPForward{}
+	if err := ssh.Unmarshal(r.Payload, &req); err != nil {
+		r.Reply(false, nil)
+		return
+	}
+	addr := fmt.Sprintf("%s:%d", req.Addr, req.Port)
+	t.activeForwardsMut.Lock()
+	l, ok := t.activeForwards[addr]
+	t.activeForwardsMut.Unlock()
+	if ok {
+		l.Close()
+	}
+	r.Reply(ok, nil)
+}
+
+func (t *Tunnel) forwardTCPIP(c ssh.Conn, addr string, port uint32, src net.Conn) {
+	defer src.Close()
+	originAddr, originPort := splitHostPort(src.RemoteAddr().String())
+	payload := ssh.Marshal(rfc4254ForwardedTCPIP{
+		Addr:       addr,
+		Port:       port,
+		OriginAddr: originAddr,
+		OriginPort: originPort,
+	})
+	ch, reqs, err := c.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		t.Debugf("forwarded-tcpip: open channel failed: %s", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	sid := nextSessionID()
+	fwdAddr := fmt.Sprintf("%s:%d", addr, port)
+	t.connStats.Open()
+	t.trackSession(nativeSessionProxyID, sid, src.RemoteAddr())
+	if t.Metrics != nil {
+		t.Metrics.ProxyOpens.WithLabelValues(fwdAddr).Inc()
+	}
+	defer t.connStats.Close()
+	defer t.untrackSession(nativeSessionProxyID, sid)
+	defer func() {
+		if t.Metrics != nil {
+			t.Metrics.ProxyCloses.WithLabelValues(fwdAddr).Inc()
+		}
+	}()
+	t.pipe(ch, src)
+}
+
+//pipe copies both directions between an ssh channel and a net.Conn,
+//waiting for both to finish before returning (a half-duplex exchange,
+//e.g. HTTP-over-tunnel, routinely has one direction finish writing well
+//before the other finishes reading the response), reporting bytes moved
+//to Config.Metrics when set.
+func (t *Tunnel) pipe(ch ssh.Channel, conn net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		n, _ := io.Copy(ch, conn)
+		if t.Metrics != nil {
+			t.Metrics.BytesTransferred.WithLabelValues("out").Add(float64(n))
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := io.Copy(conn, ch)
+		if t.Metrics != nil {
+			t.Metrics.BytesTransferred.WithLabelValues("in").Add(float64(n))
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+func splitHostPort(addr string) (string, uint32) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	var p uint32
+	fmt.Sscanf(port, "%d", &p)
+	return host, p
+}
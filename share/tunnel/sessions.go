@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"net"
+	"time"
+)
+
+//Session describes a single in-flight proxied connection, tracked so a
+//Close(ctx) with a drain deadline or a degraded keepalive can tell when it
+//is safe to tear down the underlying SSH connection.
+type Session struct {
+	ProxyID    int
+	ChannelID  string
+	RemoteAddr net.Addr
+	Opened     time.Time
+}
+
+//trackSession registers a new in-flight session for proxyID, called
+//whenever a channel is opened for a proxy (an `L:`/`R:` stream, or a native
+//ssh direct-tcpip/forwarded-tcpip channel).
+func (t *Tunnel) trackSession(proxyID int, channelID string, remote net.Addr) {
+	t.sessionsMut.Lock()
+	defer t.sessionsMut.Unlock()
+	m, ok := t.sessions[proxyID]
+	if !ok {
+		m = map[string]*Session{}
+		t.sessions[proxyID] = m
+	}
+	m[channelID] = &Session{
+		ProxyID:    proxyID,
+		ChannelID:  channelID,
+		RemoteAddr: remote,
+		Opened:     time.Now(),
+	}
+}
+
+//untrackSession removes a session previously registered with trackSession.
+func (t *Tunnel) untrackSession(proxyID int, channelID string) {
+	t.sessionsMut.Lock()
+	defer t.sessionsMut.Unlock()
+	if m, ok := t.sessions[proxyID]; ok {
+		delete(m, channelID)
+		if len(m) == 0 {
+			delete(t.sessions, proxyID)
+		}
+	}
+}
+
+//ActiveSessions returns every in-flight session across all proxies.
+func (t *Tunnel) ActiveSessions() []*Session {
+	t.sessionsMut.Lock()
+	defer t.sessionsMut.Unlock()
+	out := make([]*Session, 0)
+	for _, m := range t.sessions {
+		for _, s := range m {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+//activeSessionsForProxy returns the in-flight sessions belonging to a
+//single proxy id, backing Proxy.ActiveSessions.
+func (t *Tunnel) activeSessionsForProxy(proxyID int) []*Session {
+	t.sessionsMut.Lock()
+	defer t.sessionsMut.Unlock()
+	m := t.sessions[proxyID]
+	out := make([]*Session, 0, len(m))
+	for _, s := range m {
+		out = append(out, s)
+	}
+	return out
+}
+
+//ActiveSessions returns this proxy's in-flight sessions.
+func (p *Proxy) ActiveSessions() []*Session {
+	return p.tunnel.activeSessionsForProxy(p.id)
+}
@@ -7,13 +7,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-socks5"
 	"github.com/jpillora/chisel/share/cio"
 	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/metrics"
 	"github.com/jpillora/chisel/share/settings"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
@@ -26,6 +29,31 @@ type Config struct {
 	Outbound  bool
 	Socks     bool
 	KeepAlive time.Duration
+	//OnKeepAlive, when set, is called after every keepalive ping with the
+	//measured round-trip time (and any error). The client reconnect loop
+	//uses this to feed endpoint.Pool.MarkSuccess/MarkFailure for its
+	//multi-server health-based failover.
+	OnKeepAlive func(rtt time.Duration, err error)
+	//DegradedGraceSessions is the largest number of active sessions for
+	//which a missed keepalive ping is tolerated: with at most this many
+	//sessions a missed ping marks the tunnel Degraded and retries faster,
+	//only closing once sessions drain or DegradedHardTimeout elapses.
+	//Above this threshold a missed ping tears the connection down
+	//immediately. Zero disables grace (old behaviour).
+	DegradedGraceSessions int
+	//DegradedHardTimeout bounds how long a Degraded tunnel is kept alive
+	//waiting for active sessions to drain before it is closed anyway.
+	DegradedHardTimeout time.Duration
+	//LogHandler, when set, receives structured log events (an event name
+	//plus key/value fields such as remote_addr, local_addr, proxy_id)
+	//instead of the printf-style strings cio.Logger.Debugf produces. No
+	//event carries per-session byte counts. Plug in an
+	//adapter over log/slog or logrus here for machine-parsable output.
+	LogHandler LogHandler
+	//Metrics, when set, receives Prometheus counters for this tunnel's SSH
+	//connections, keepalive RTT and drain state. See share/metrics; serve
+	//it with Config.MetricsListen on the client/server.
+	Metrics *metrics.Collectors
 }
 
 //Tunnel represents an SSH tunnel with proxy capabilities.
@@ -47,13 +75,34 @@ type Tunnel struct {
 	connStats   cnet.ConnCount
 	socksServer *socks5.Server
 	RemoteIP  string
+	//activeForwards tracks RFC 4254 "tcpip-forward" listeners opened by
+	//native ssh clients (ssh -R), keyed by "host:port"
+	activeForwardsMut sync.Mutex
+	activeForwards    map[string]net.Listener
+	//proxies created by BindRemotes, kept around so their listeners can be
+	//exported as file descriptors across a graceful restart
+	proxiesMut sync.Mutex
+	proxies    []*Proxy
+	//draining is set while the tunnel is shutting down gracefully: no new
+	//SSH channels are accepted, but existing ones are left to finish
+	draining int32
+	//degraded is set while a missed keepalive ping is being tolerated
+	//because active sessions are still below the configured grace
+	//threshold (see keepAliveLoop)
+	degraded int32
+	//sessions is the per-proxy registry of in-flight channels, keyed by
+	//proxy id then by a per-channel session id
+	sessionsMut sync.Mutex
+	sessions    map[int]map[string]*Session
 }
 
 //New Tunnel from the given Config
 func New(c Config) *Tunnel {
 	c.Logger = c.Logger.Fork("tun")
 	t := &Tunnel{
-		Config: c,
+		Config:         c,
+		activeForwards: map[string]net.Listener{},
+		sessions:       map[int]map[string]*Session{},
 	}
 	t.activatingConn.Add(1)
 	//setup socks server (not listening on any port!)
@@ -93,12 +142,18 @@ func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Reque
 		go t.keepAliveLoop(c)
 	}
 	//block until closed
-	go t.handleSSHRequests(reqs)
-	go t.handleSSHChannels(chans)
-	msg := fmt.Sprintf("[LocalAddr:%s]=>[RemoteAddr:%s]", c.LocalAddr(), c.RemoteAddr())
-	t.Debugf("%s, SSH connected", msg)
+	//demux the global-requests and new-channels streams so that RFC 4254
+	//forwarding (used by native ssh/sshgw clients) and chisel's own
+	//request/channel types can share a single SSH connection
+	go t.handleSSHRequests(t.demuxRequests(c, reqs))
+	go t.handleSSHChannels(t.demuxChannels(c, chans))
+	t.logEvent("ssh_connected", "local_addr", c.LocalAddr(), "remote_addr", c.RemoteAddr())
+	if t.Metrics != nil {
+		t.Metrics.ActiveConnections.Inc()
+		defer t.Metrics.ActiveConnections.Dec()
+	}
 	err := c.Wait()
-	t.Debugf("%s,SSH disconnected", msg)
+	t.logEvent("ssh_disconnected", "local_addr", c.LocalAddr(), "remote_addr", c.RemoteAddr())
 	//mark inactive and block
 	t.activatingConn.Add(1)
 	t.activeConnMut.Lock()
@@ -161,68 +216,204 @@ func (t *Tunnel) BindRemotes(ctx context.Context, remotes []*settings.Remote) er
 		proxies[i] = p
 		t.proxyCount++
 	}
+	t.proxiesMut.Lock()
+	t.proxies = append(t.proxies, proxies...)
+	t.proxiesMut.Unlock()
 	//TODO: handle tunnel close
 	eg, ctx := errgroup.WithContext(ctx)
-	var msg string
 	for _, proxy := range proxies {
-		msg = fmt.Sprintf("[LocalAddr:%s]=>[RemoteAddr:%s]", proxy.tcp.Addr(), proxy.remote.Remote())
 		p := proxy
+		t.logEvent("proxy_bound", "proxy_id", p.id, "local_addr", p.tcp.Addr(), "remote", p.remote.Remote())
+		if t.Metrics != nil {
+			//pre-populate the per-remote series so they graph as zero
+			//before the first connection, rather than being absent
+			t.Metrics.ProxyOpens.WithLabelValues(p.remote.Remote())
+			t.Metrics.ProxyCloses.WithLabelValues(p.remote.Remote())
+		}
 		eg.Go(func() error {
 			return p.Run(ctx)
 		})
 	}
-	t.Debugf("%s,Bound proxies", msg)
 	err := eg.Wait()
-	t.Debugf("%s,Unbound proxies", msg)
+	t.logEvent("proxies_unbound", "count", len(proxies))
 	return err
 }
 
 func (t *Tunnel) keepAliveLoop(sshConn ssh.Conn) {
-	msg := fmt.Sprintf("[LocalAddr:%s]=>[RemoteAddr:%s]", sshConn.LocalAddr(), sshConn.RemoteAddr())
 	defer func() {
 		//close ssh connection on abnormal ping
-		t.Debugf("%s,close ssh connection on abnormal ping", msg)
+		t.logEvent("ssh_closed_on_ping_failure", "remote_addr", sshConn.RemoteAddr())
 		sshConn.Close()
 	}()
-	//ping forever
+	var degradedSince time.Time
+	interval := t.Config.KeepAlive
+	//ping forever, speeding up while degraded
 	for {
-		time.Sleep(t.Config.KeepAlive)
+		time.Sleep(interval)
+		start := time.Now()
+		var pingErr error
 		select {
 		case <-time.After(t.Config.KeepAlive):
-			return
+			pingErr = errors.New("keepalive timed out")
 		case err := <-t.KeepAliveChan(sshConn):
-			if err != nil {
-				return
+			pingErr = err
+		}
+		rtt := time.Since(start)
+		if t.OnKeepAlive != nil {
+			t.OnKeepAlive(rtt, pingErr)
+		}
+		if t.Metrics != nil && pingErr == nil {
+			t.Metrics.KeepAliveRTT.Observe(rtt.Seconds())
+		}
+		if pingErr == nil {
+			if t.setDegraded(false) {
+				t.logEvent("ssh_recovered", "remote_addr", sshConn.RemoteAddr())
 			}
+			interval = t.Config.KeepAlive
+			degradedSince = time.Time{}
+			continue
+		}
+		sessions := len(t.ActiveSessions())
+		if sessions > t.Config.DegradedGraceSessions {
+			//over the grace threshold, or grace disabled: tear down now
+			return
+		}
+		if degradedSince.IsZero() {
+			degradedSince = time.Now()
+			t.setDegraded(true)
+			t.logEvent("ssh_degraded", "remote_addr", sshConn.RemoteAddr(), "active_sessions", sessions)
+		}
+		if t.Config.DegradedHardTimeout > 0 && time.Since(degradedSince) > t.Config.DegradedHardTimeout {
+			t.logEvent("ssh_degraded_timeout", "remote_addr", sshConn.RemoteAddr())
+			return
+		}
+		if sessions == 0 {
+			t.logEvent("ssh_degraded_drained", "remote_addr", sshConn.RemoteAddr())
+			return
+		}
+		//retry faster while degraded
+		interval = t.Config.KeepAlive / 4
+		if interval <= 0 {
+			interval = time.Second
 		}
 	}
 }
 
+//setDegraded sets the degraded flag, returning true if it changed.
+func (t *Tunnel) setDegraded(degraded bool) bool {
+	v := int32(0)
+	if degraded {
+		v = 1
+	}
+	return atomic.SwapInt32(&t.degraded, v) != v
+}
+
+//IsDegraded reports whether the tunnel is tolerating a missed keepalive
+//ping because it still has active sessions below the grace threshold.
+func (t *Tunnel) IsDegraded() bool {
+	return atomic.LoadInt32(&t.degraded) == 1
+}
+
+//KeepAliveChan sends a single ping and returns a channel carrying its
+//result. The channel is buffered by one so a caller that gives up
+//waiting (keepAliveLoop's timeout branch) never leaves this goroutine
+//blocked on a send nobody will ever read again - under
+//DegradedGraceSessions a slow/failed ping is retried every interval for
+//up to DegradedHardTimeout, so an unbuffered channel here would leak one
+//goroutine per retry for the whole degraded window.
 func (t *Tunnel) KeepAliveChan(sshConn ssh.Conn) <-chan error {
-	msg := fmt.Sprintf("[LocalAddr:%s]=>[RemoteAddr:%s]", sshConn.LocalAddr(), sshConn.RemoteAddr())
-	ch := make(chan error)
+	ch := make(chan error, 1)
 	go func() {
 		defer close(ch)
 		_, b, err := sshConn.SendRequest("ping", true, nil)
 		if err != nil {
-			t.Debugf("%s ping error,err=%s", msg, err)
+			t.logEvent("ping_error", "remote_addr", sshConn.RemoteAddr(), "error", err)
 			ch <- err
+			return
 		}
 		if len(b) > 0 && !bytes.Equal(b, []byte("pong")) {
-			// t.Debugf("strange ping response")
-			t.Debugf("%s strange ping response", msg)
+			t.logEvent("ping_strange_response", "remote_addr", sshConn.RemoteAddr())
 			ch <- fmt.Errorf("strange ping response")
 		}
 	}()
 	return ch
 }
 
-// Close ssh connection
+//Close stops accepting new SSH channels and closes the ssh connection.
+//If ctx carries a deadline, Close first waits for ActiveSessions to drain
+//to zero, up to that deadline, before closing - giving in-flight proxied
+//connections a chance to finish instead of being slammed shut. With no
+//deadline on ctx, Close tears down immediately as before.
 func (t *Tunnel) Close(ctx context.Context) error {
 	sshConn := t.getSSH(ctx)
 	if sshConn == nil {
 		t.Debugf("No ssh-conn to close")
 		return nil
 	}
+	t.SetDraining(true)
+	if _, ok := ctx.Deadline(); ok {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+	drain:
+		for {
+			if len(t.ActiveSessions()) == 0 {
+				break drain
+			}
+			select {
+			case <-ctx.Done():
+				break drain
+			case <-ticker.C:
+			}
+		}
+	}
 	return sshConn.Close()
 }
+
+//ActiveConnCount returns the number of in-flight proxied connections,
+//used by a graceful restart/shutdown to know when it is safe to exit.
+func (t *Tunnel) ActiveConnCount() int {
+	return int(t.connStats.Count())
+}
+
+//SetDraining marks the tunnel as draining: BindSSH stops accepting new
+//SSH channels (see demuxChannels) while connections already in flight are
+//left to finish on their own.
+func (t *Tunnel) SetDraining(draining bool) {
+	v := int32(0)
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&t.draining, v)
+	t.Debugf("draining=%v", draining)
+	if t.Metrics != nil {
+		t.Metrics.DrainInProgress.Set(float64(v))
+	}
+}
+
+//IsDraining reports whether SetDraining(true) has been called.
+func (t *Tunnel) IsDraining() bool {
+	return atomic.LoadInt32(&t.draining) == 1
+}
+
+//ListenerFiles returns the underlying file descriptors of every proxy
+//listener bound by BindRemotes so far, for hand-off to a replacement
+//process across a graceful restart. Listeners which don't support file
+//export (e.g. non-TCP) are skipped.
+func (t *Tunnel) ListenerFiles() ([]*os.File, error) {
+	t.proxiesMut.Lock()
+	proxies := append([]*Proxy{}, t.proxies...)
+	t.proxiesMut.Unlock()
+	files := make([]*os.File, 0, len(proxies))
+	for _, p := range proxies {
+		fl, ok := interface{}(p.tcp).(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", p.tcp.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}